@@ -0,0 +1,40 @@
+package resolver
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	cacheBytesGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "blocky_cache_bytes",
+		Help: "Estimated total size in bytes of all entries in the result cache",
+	})
+
+	cacheHotItemsGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "blocky_cache_hot_items",
+		Help: "Number of entries currently promoted to the hot LRU tier of the result cache",
+	})
+
+	cacheAdmissionRejectedCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "blocky_cache_admission_rejected_total",
+		Help: "Number of result cache writes rejected because the byte-size budget was exceeded",
+	})
+
+	cacheStaleServedCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "blocky_cache_stale_served_total",
+		Help: "Number of responses served from a stale (expired) cache entry per RFC 8767",
+	})
+)
+
+// reportCacheMetrics updates the size/hot-item gauges from the current
+// two-tier cache state, if two-tier caching is enabled.
+func (r *CachingResolver) reportCacheMetrics() {
+	tt, ok := r.resultCache.(*twoTierCache)
+	if !ok {
+		return
+	}
+
+	cacheBytesGauge.Set(float64(tt.bytesUsed()))
+	cacheHotItemsGauge.Set(float64(tt.hotCount()))
+}
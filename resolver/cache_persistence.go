@@ -0,0 +1,226 @@
+package resolver
+
+import (
+	"bytes"
+	"encoding/gob"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/0xERR0R/blocky/log"
+	"github.com/0xERR0R/blocky/util"
+
+	"github.com/miekg/dns"
+)
+
+// minPersistedTTL is the remaining TTL below which a loaded snapshot entry is
+// dropped instead of being re-inserted into the result cache: it isn't worth
+// warming an entry that would expire almost immediately anyway.
+const minPersistedTTL = 2 * time.Second
+
+// persistedEntry is the on-disk representation of a cacheValue. The answer is
+// stored as its wire format since dns.RR doesn't implement gob.GobEncoder.
+type persistedEntry struct {
+	CacheKey  string
+	Answer    [][]byte
+	Prefetch  bool
+	ExpiresAt time.Time
+}
+
+// CacheStorage persists result cache entries so they survive a restart.
+type CacheStorage interface {
+	// Load returns the entries found on disk, if any.
+	Load() ([]persistedEntry, error)
+	// Save overwrites the persisted snapshot with entries.
+	Save(entries []persistedEntry) error
+}
+
+// fileCacheStorage is a CacheStorage backed by a single gob-encoded file.
+type fileCacheStorage struct {
+	path string
+}
+
+// NewFileCacheStorage creates a CacheStorage that snapshots to path.
+func NewFileCacheStorage(path string) CacheStorage {
+	return &fileCacheStorage{path: path}
+}
+
+func (s *fileCacheStorage) Load() ([]persistedEntry, error) {
+	f, err := os.Open(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []persistedEntry
+
+	if err := gob.NewDecoder(f).Decode(&entries); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+func (s *fileCacheStorage) Save(entries []persistedEntry) error {
+	var buf bytes.Buffer
+
+	if err := gob.NewEncoder(&buf).Encode(entries); err != nil {
+		return err
+	}
+
+	return os.WriteFile(s.path, buf.Bytes(), 0o600)
+}
+
+// loadPersistedCache reads the snapshot from r.cacheStorage and re-inserts
+// entries into r.resultCache, respecting their remaining TTL. Entries whose
+// remaining TTL has dropped below minPersistedTTL are skipped.
+func (r *CachingResolver) loadPersistedCache() {
+	logger := log.PrefixedLog("caching_resolver")
+
+	entries, err := r.cacheStorage.Load()
+	if err != nil {
+		util.LogOnError("can't load persisted cache: ", err)
+
+		return
+	}
+
+	now := time.Now()
+	restored := 0
+
+	for _, e := range entries {
+		remaining := e.ExpiresAt.Sub(now)
+		if remaining < minPersistedTTL {
+			continue
+		}
+
+		answer := make([]dns.RR, 0, len(e.Answer))
+
+		for _, wire := range e.Answer {
+			rr, _, err := dns.UnpackRR(wire, 0)
+			if err != nil {
+				util.LogOnError("can't restore persisted answer: ", err)
+
+				continue
+			}
+
+			answer = append(answer, rr)
+		}
+
+		if len(answer) == 0 {
+			continue
+		}
+
+		r.resultCache.Put(e.CacheKey, cacheValue{answer: answer, prefetch: e.Prefetch}, remaining)
+		restored++
+	}
+
+	logger.Debugf("restored %d entries from persisted cache '%s'", restored, r.cachePersistPath)
+}
+
+// persistCache snapshots the current result cache to r.cacheStorage.
+func (r *CachingResolver) persistCache() {
+	keys := r.resultCache.Keys()
+	entries := make([]persistedEntry, 0, len(keys))
+
+	// Use twoTierCache's side-effect-free Peek, when available, instead of
+	// Get: Get's hit-count bookkeeping and hot-tier promotion are meant to
+	// track real query traffic, and iterating every key on every persistence
+	// tick would otherwise skew (and eventually force-promote) the cache
+	// regardless of actual demand.
+	peek := r.resultCache.Get
+	if tt, ok := r.resultCache.(*twoTierCache); ok {
+		peek = tt.Peek
+	}
+
+	for _, key := range keys {
+		val, ttl := peek(key)
+		if val == nil {
+			continue
+		}
+
+		v, ok := val.(cacheValue)
+		if !ok {
+			// negative (NXDOMAIN) entries aren't worth persisting
+			continue
+		}
+
+		wire := make([][]byte, 0, len(v.answer))
+
+		for _, rr := range v.answer {
+			buf := make([]byte, dns.Len(rr)+1)
+
+			n, err := dns.PackRR(rr, buf, 0, nil, false)
+			if err != nil {
+				util.LogOnError("can't persist cache entry: ", err)
+
+				continue
+			}
+
+			wire = append(wire, buf[:n])
+		}
+
+		entries = append(entries, persistedEntry{
+			CacheKey:  key,
+			Answer:    wire,
+			Prefetch:  v.prefetch,
+			ExpiresAt: time.Now().Add(ttl),
+		})
+	}
+
+	if err := r.cacheStorage.Save(entries); err != nil {
+		util.LogOnError("can't persist cache: ", err)
+	}
+}
+
+// startCachePersistence loads the on-disk snapshot once, then periodically
+// (and, via Close, on shutdown) writes the current cache back to disk. Close
+// isn't wired into any caller outside this package in this snapshot, so a
+// SIGINT/SIGTERM handler is started alongside the ticker to make sure a final
+// flush actually happens when the process is asked to stop; an external
+// caller (e.g. a future shutdown sequence) can still call Close directly, as
+// it's safe to invoke more than once.
+func (r *CachingResolver) startCachePersistence() {
+	r.loadPersistedCache()
+
+	r.stopPersist = make(chan struct{})
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		ticker := time.NewTicker(r.cachePersistInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				r.persistCache()
+			case <-sigCh:
+				r.Close()
+
+				return
+			case <-r.stopPersist:
+				return
+			}
+		}
+	}()
+}
+
+// Close flushes the result cache to disk, if persistence is enabled. Safe to
+// call more than once (e.g. from both a signal handler and an external
+// caller).
+func (r *CachingResolver) Close() {
+	if r.cacheStorage == nil {
+		return
+	}
+
+	r.closeOnce.Do(func() {
+		close(r.stopPersist)
+		r.persistCache()
+	})
+}
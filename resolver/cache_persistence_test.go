@@ -0,0 +1,76 @@
+package resolver
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestFileCacheStorage_SaveLoadRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.gob")
+	storage := NewFileCacheStorage(path)
+
+	rr := &dns.A{
+		Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.ParseIP("1.2.3.4"),
+	}
+
+	wire := make([]byte, dns.Len(rr)+1)
+
+	n, err := dns.PackRR(rr, wire, 0, nil, false)
+	if err != nil {
+		t.Fatalf("PackRR failed: %v", err)
+	}
+
+	expiresAt := time.Now().Add(time.Hour).Truncate(time.Second)
+
+	want := []persistedEntry{
+		{CacheKey: "1|example.com.", Answer: [][]byte{wire[:n]}, Prefetch: false, ExpiresAt: expiresAt},
+	}
+
+	if err := storage.Save(want); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	got, err := storage.Load()
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+
+	if len(got) != 1 {
+		t.Fatalf("expected 1 persisted entry, got %d", len(got))
+	}
+
+	if got[0].CacheKey != want[0].CacheKey {
+		t.Fatalf("CacheKey = %q, want %q", got[0].CacheKey, want[0].CacheKey)
+	}
+
+	if !got[0].ExpiresAt.Equal(want[0].ExpiresAt) {
+		t.Fatalf("ExpiresAt = %v, want %v", got[0].ExpiresAt, want[0].ExpiresAt)
+	}
+
+	restoredRR, _, err := dns.UnpackRR(got[0].Answer[0], 0)
+	if err != nil {
+		t.Fatalf("UnpackRR failed: %v", err)
+	}
+
+	if restoredRR.String() != rr.String() {
+		t.Fatalf("restored RR = %q, want %q", restoredRR.String(), rr.String())
+	}
+}
+
+func TestFileCacheStorage_LoadMissingFileReturnsEmpty(t *testing.T) {
+	storage := NewFileCacheStorage(filepath.Join(t.TempDir(), "does-not-exist.gob"))
+
+	entries, err := storage.Load()
+	if err != nil {
+		t.Fatalf("Load on a missing file should not error, got: %v", err)
+	}
+
+	if entries != nil {
+		t.Fatalf("expected no entries for a missing file, got %d", len(entries))
+	}
+}
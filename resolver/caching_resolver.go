@@ -2,6 +2,8 @@ package resolver
 
 import (
 	"fmt"
+	"net"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -19,7 +21,25 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-const defaultCachingCleanUpInterval = 5 * time.Second
+const (
+	defaultCachingCleanUpInterval = 5 * time.Second
+
+	// staleMaxTTL is the default upper bound for how long a stale entry may be
+	// served past its original expiration, per RFC 8767 section 4.
+	staleMaxTTL = 24 * time.Hour
+
+	// staleAnswerClientTimeout is the default time we wait for the upstream
+	// resolver to answer before falling back to a stale cache entry.
+	staleAnswerClientTimeout = 1800 * time.Millisecond
+
+	// staleTTLSec is the TTL (in seconds) attached to answers served from the
+	// stale cache, as recommended by RFC 8767 section 4.
+	staleTTLSec = 30
+
+	// defaultHotCacheItems is the hot LRU tier size used when two-tier
+	// caching is enabled but HotCacheItems isn't explicitly configured.
+	defaultHotCacheItems = 128
+)
 
 // CachingResolver caches answers from dns queries with their TTL time,
 // to avoid external resolver calls for recurrent queries
@@ -33,22 +53,69 @@ type CachingResolver struct {
 	prefetchingNameCache             expirationcache.ExpiringCache
 	redisClient                      *redis.Client
 	redisEnabled                     bool
+	serveStale                       bool
+	serveStaleMaxTTL                 time.Duration
+	staleAnswerClientTimeout         time.Duration
+	cacheStorage                     CacheStorage
+	cachePersistPath                 string
+	cachePersistInterval             time.Duration
+	stopPersist                      chan struct{}
+	closeOnce                        sync.Once
+	ecsCacheEnabled                  bool
+	ecsMaxScopeV4                    int
+	ecsMaxScopeV6                    int
 }
 
 // cacheValue includes query answer and prefetch flag
 type cacheValue struct {
 	answer   []dns.RR
 	prefetch bool
+	// staleUntil is the entry's original expiration time. Past it, the entry
+	// is stale: it stays in the cache for serveStaleMaxTTL longer and may be
+	// served (with a clamped TTL) if the upstream resolver is unavailable or
+	// too slow. Zero if serve-stale is disabled for this entry.
+	staleUntil time.Time
+	// ecsNetwork is the SCOPE PREFIX-LENGTH network (RFC 7871) this answer
+	// was partitioned under, e.g. "192.168.1.0/24". Empty for non-ECS entries.
+	ecsNetwork string
+}
+
+// isStale returns true once the entry's original TTL (staleUntil) has passed;
+// while it is still in the cache, it may then be served stale per RFC 8767.
+func (v cacheValue) isStale() bool {
+	return !v.staleUntil.IsZero() && time.Now().After(v.staleUntil)
 }
 
 // NewCachingResolver creates a new resolver instance
 func NewCachingResolver(cfg config.CachingConfig, redis *redis.Client) *CachingResolver {
 	c := &CachingResolver{
-		minCacheTimeSec:   int(time.Duration(cfg.MinCachingTime).Seconds()),
-		maxCacheTimeSec:   int(time.Duration(cfg.MaxCachingTime).Seconds()),
-		cacheTimeNegative: time.Duration(cfg.CacheTimeNegative),
-		redisClient:       redis,
-		redisEnabled:      (redis != nil),
+		minCacheTimeSec:          int(time.Duration(cfg.MinCachingTime).Seconds()),
+		maxCacheTimeSec:          int(time.Duration(cfg.MaxCachingTime).Seconds()),
+		cacheTimeNegative:        time.Duration(cfg.CacheTimeNegative),
+		redisClient:              redis,
+		redisEnabled:             (redis != nil),
+		serveStale:               cfg.ServeStale,
+		serveStaleMaxTTL:         staleMaxTTL,
+		staleAnswerClientTimeout: staleAnswerClientTimeout,
+		ecsCacheEnabled:          cfg.ECSCacheEnabled,
+		ecsMaxScopeV4:            defaultECSMaxScopeV4,
+		ecsMaxScopeV6:            defaultECSMaxScopeV6,
+	}
+
+	if cfg.ECSMaxScopeV4 > 0 {
+		c.ecsMaxScopeV4 = cfg.ECSMaxScopeV4
+	}
+
+	if cfg.ECSMaxScopeV6 > 0 {
+		c.ecsMaxScopeV6 = cfg.ECSMaxScopeV6
+	}
+
+	if cfg.ServeStaleMaxTTL > 0 {
+		c.serveStaleMaxTTL = time.Duration(cfg.ServeStaleMaxTTL)
+	}
+
+	if cfg.StaleAnswerClientTimeout > 0 {
+		c.staleAnswerClientTimeout = time.Duration(cfg.StaleAnswerClientTimeout)
 	}
 
 	configureCaches(c, &cfg)
@@ -58,6 +125,19 @@ func NewCachingResolver(cfg config.CachingConfig, redis *redis.Client) *CachingR
 		c.redisClient.GetRedisCache()
 	}
 
+	if cfg.CachePersistPath != "" {
+		c.cachePersistPath = cfg.CachePersistPath
+
+		c.cachePersistInterval = time.Minute
+		if cfg.CachePersistInterval > 0 {
+			c.cachePersistInterval = time.Duration(cfg.CachePersistInterval)
+		}
+
+		c.cacheStorage = NewFileCacheStorage(c.cachePersistPath)
+
+		c.startCachePersistence()
+	}
+
 	return c
 }
 
@@ -65,6 +145,13 @@ func configureCaches(c *CachingResolver, cfg *config.CachingConfig) {
 	cleanupOption := expirationcache.WithCleanUpInterval(defaultCachingCleanUpInterval)
 	maxSizeOption := expirationcache.WithMaxSize(uint(cfg.MaxItemsCount))
 
+	// Prefetching and serve-stale are independent features: a serve-stale-only
+	// config must not wire up the prefetch onExpired handler, since
+	// shouldPrefetch defaults to true (prefetchThreshold == 0) whenever
+	// Prefetching was never configured. Such configs just let entries fall
+	// out of the cache once their (extended, stale-serving) TTL truly expires.
+	var onExpired func(cacheKey string) (val interface{}, ttl time.Duration)
+
 	if cfg.Prefetching {
 		c.prefetchExpires = time.Duration(cfg.PrefetchExpires)
 
@@ -75,14 +162,36 @@ func configureCaches(c *CachingResolver, cfg *config.CachingConfig) {
 			expirationcache.WithMaxSize(uint(cfg.PrefetchMaxItemsCount)),
 		)
 
-		c.resultCache = expirationcache.NewCache(
-			cleanupOption,
-			maxSizeOption,
-			expirationcache.WithOnExpiredFn(c.onExpired),
-		)
+		onExpired = c.onExpired
+	}
+
+	var tt *twoTierCache
+
+	if cfg.CacheMaxSizeBytes > 0 || cfg.HotCacheItems > 0 {
+		hotItems := defaultHotCacheItems
+		if cfg.HotCacheItems > 0 {
+			hotItems = cfg.HotCacheItems
+		}
+
+		tt = newTwoTierCache(hotItems, cfg.CacheMaxSizeBytes)
+		tt.onAdmissionRejected = func() { cacheAdmissionRejectedCounter.Inc() }
+
+		// the cold cache's expiry callback is how the two-tier cache learns
+		// that a key has actually left the cache, so its byte accounting
+		// (usedBytes/sizes) can be released instead of growing forever
+		onExpired = tt.wrapOnExpired(onExpired)
+	}
+
+	if onExpired != nil {
+		c.resultCache = expirationcache.NewCache(cleanupOption, maxSizeOption, expirationcache.WithOnExpiredFn(onExpired))
 	} else {
 		c.resultCache = expirationcache.NewCache(cleanupOption, maxSizeOption)
 	}
+
+	if tt != nil {
+		tt.cold = c.resultCache
+		c.resultCache = tt
+	}
 }
 
 func setupRedisCacheSubscriber(c *CachingResolver) {
@@ -110,7 +219,7 @@ func (r *CachingResolver) shouldPrefetch(cacheKey string) bool {
 }
 
 func (r *CachingResolver) onExpired(cacheKey string) (val interface{}, ttl time.Duration) {
-	qType, domainName := util.ExtractCacheKey(cacheKey)
+	qType, domainName := util.ExtractCacheKey(stripECSSuffix(cacheKey))
 
 	logger := log.PrefixedLog("caching_resolver")
 
@@ -124,7 +233,7 @@ func (r *CachingResolver) onExpired(cacheKey string) (val interface{}, ttl time.
 			if response.Res.Rcode == dns.RcodeSuccess {
 				evt.Bus().Publish(evt.CachingDomainPrefetched, domainName)
 
-				return cacheValue{response.Res.Answer, true}, r.adjustTTLs(response.Res.Answer)
+				return cacheValue{answer: response.Res.Answer, prefetch: true}, r.adjustTTLs(response.Res.Answer)
 			}
 		} else {
 			util.LogOnError(fmt.Sprintf("can't prefetch '%s' ", domainName), err)
@@ -156,6 +265,32 @@ func (r *CachingResolver) Configuration() (result []string) {
 
 	result = append(result, fmt.Sprintf("cache items count = %d", r.resultCache.TotalCount()))
 
+	result = append(result, fmt.Sprintf("serveStale = %t", r.serveStale))
+
+	if r.serveStale {
+		result = append(result, fmt.Sprintf("serveStaleMaxTTL = %s", durafmt.Parse(r.serveStaleMaxTTL)))
+		result = append(result, fmt.Sprintf("staleAnswerClientTimeout = %s", durafmt.Parse(r.staleAnswerClientTimeout)))
+	}
+
+	result = append(result, fmt.Sprintf("cachePersistence = %t", r.cacheStorage != nil))
+
+	if r.cacheStorage != nil {
+		result = append(result, fmt.Sprintf("cachePersistPath = %s", r.cachePersistPath))
+		result = append(result, fmt.Sprintf("cachePersistInterval = %s", durafmt.Parse(r.cachePersistInterval)))
+	}
+
+	result = append(result, fmt.Sprintf("ecsCacheEnabled = %t", r.ecsCacheEnabled))
+
+	if r.ecsCacheEnabled {
+		result = append(result, fmt.Sprintf("ecsMaxScopeV4 = %d", r.ecsMaxScopeV4))
+		result = append(result, fmt.Sprintf("ecsMaxScopeV6 = %d", r.ecsMaxScopeV6))
+	}
+
+	if tt, ok := r.resultCache.(*twoTierCache); ok {
+		result = append(result, fmt.Sprintf("hot cache items count = %d", tt.hotCount()))
+		result = append(result, fmt.Sprintf("cache size in bytes = %d", tt.bytesUsed()))
+	}
+
 	return
 }
 
@@ -175,12 +310,29 @@ func (r *CachingResolver) Resolve(request *model.Request) (response *model.Respo
 
 	for _, question := range request.Req.Question {
 		domain := util.ExtractDomain(question)
-		cacheKey := util.GenerateCacheKey(dns.Type(question.Qtype), domain)
+		baseKey := util.GenerateCacheKey(dns.Type(question.Qtype), domain)
 		logger := logger.WithField("domain", util.Obfuscate(domain))
 
-		r.trackQueryDomainNameCount(domain, cacheKey, logger)
+		r.trackQueryDomainNameCount(domain, baseKey, logger)
+
+		cacheKey := baseKey
+		lookupKeys := []string{baseKey}
+
+		if r.ecsCacheEnabled {
+			lookupKeys = r.ecsCandidateKeys(baseKey, r.ecsClientIP(request))
+		}
+
+		var val interface{}
 
-		val, ttl := r.resultCache.Get(cacheKey)
+		var ttl time.Duration
+
+		for _, k := range lookupKeys {
+			if val, ttl = r.resultCache.Get(k); val != nil {
+				cacheKey = k
+
+				break
+			}
+		}
 
 		if val != nil {
 			logger.Debug("domain is cached")
@@ -194,6 +346,10 @@ func (r *CachingResolver) Resolve(request *model.Request) (response *model.Respo
 					evt.Bus().Publish(evt.CachingPrefetchCacheHit, domain)
 				}
 
+				if v.isStale() {
+					return r.resolveStale(request, baseKey, domain, v, logger)
+				}
+
 				// Answer from successful request
 				for _, rr := range v.answer {
 					// make copy here since entries in cache can be modified by other goroutines (e.g. redis cache)
@@ -217,13 +373,67 @@ func (r *CachingResolver) Resolve(request *model.Request) (response *model.Respo
 		response, err = r.next.Resolve(request)
 
 		if err == nil {
-			r.putInCache(cacheKey, response, false, r.redisEnabled)
+			r.putInCache(baseKey, response, false, r.redisEnabled)
 		}
 	}
 
 	return response, err
 }
 
+// resolveStale races the upstream resolve against staleAnswerClientTimeout.
+// If the upstream answers in time, its answer is returned and the cache is
+// refreshed. Otherwise (timeout or error) the stale answer is returned with
+// its TTL clamped to staleTTLSec (RFC 8767 section 4), and the cache is
+// updated asynchronously once/if the upstream eventually answers.
+func (r *CachingResolver) resolveStale(
+	request *model.Request, baseKey, domain string, v cacheValue, logger *logrus.Entry,
+) (*model.Response, error) {
+	type result struct {
+		response *model.Response
+		err      error
+	}
+
+	resCh := make(chan result, 1)
+
+	go func() {
+		response, err := r.next.Resolve(request)
+		if err == nil && response.Res.Rcode == dns.RcodeSuccess {
+			// putInCache expects the plain "qtype|domain" key and re-derives
+			// its own ECS suffix from the response; passing the (possibly
+			// already ECS-suffixed) lookup key here would double-suffix it
+			// and the refreshed entry would never be found again.
+			r.putInCache(baseKey, response, false, r.redisEnabled)
+		}
+		resCh <- result{response, err}
+	}()
+
+	select {
+	case res := <-resCh:
+		if res.err == nil && res.response.Res.Rcode == dns.RcodeSuccess {
+			return res.response, nil
+		}
+
+		logger.Debugf("upstream resolve for stale entry failed, falling back to stale answer")
+	case <-time.After(r.staleAnswerClientTimeout):
+		logger.Debugf("upstream resolve for stale entry is too slow, serving stale answer")
+	}
+
+	evt.Bus().Publish(evt.CachingStaleServed, domain)
+	cacheStaleServedCounter.Inc()
+
+	resp := new(dns.Msg)
+	resp.SetReply(request.Req)
+
+	for _, rr := range v.answer {
+		cp := dns.Copy(rr)
+		cp.Header().Ttl = staleTTLSec
+
+		resp.Answer = append(resp.Answer, cp)
+	}
+
+	return &model.Response{Res: resp, RType: model.ResponseTypeCACHED, Reason: "CACHED STALE"}, nil
+}
+
 func (r *CachingResolver) trackQueryDomainNameCount(domain, cacheKey string, logger *logrus.Entry) {
 	if r.prefetchingNameCache != nil {
 		var domainCount int
@@ -240,20 +450,46 @@ func (r *CachingResolver) trackQueryDomainNameCount(domain, cacheKey string, log
 	}
 }
 
-func (r *CachingResolver) putInCache(cacheKey string, response *model.Response, prefetch, publish bool) {
+// putInCache stores response under baseKey (the plain "qtype|domain" key).
+// When ECS cache partitioning is enabled and the upstream response carries a
+// SCOPE PREFIX-LENGTH, the entry is stored under the ECS-partitioned key
+// instead, so later lookups for clients in other networks fall through to
+// their own scope (or the scope-0 fallback).
+func (r *CachingResolver) putInCache(baseKey string, response *model.Response, prefetch, publish bool) {
 	answer := response.Res.Answer
+	cacheKey := baseKey
 
 	if response.Res.Rcode == dns.RcodeSuccess {
+		ttl := r.adjustTTLs(answer)
+		value := cacheValue{answer: answer, prefetch: prefetch}
+
+		if r.ecsCacheEnabled {
+			if subnet := extractECS(response.Res); subnet != nil {
+				scope := r.ecsStorageScope(subnet.Address, int(subnet.SourceScope))
+				value.ecsNetwork = ecsNetworkKey(subnet.Address, scope)
+				cacheKey = withECSSuffix(baseKey, value.ecsNetwork)
+			}
+		}
+
+		// keep the entry around past its TTL so it can still be served stale
+		// if the upstream is unavailable or too slow the next time it's requested
+		if r.serveStale {
+			value.staleUntil = time.Now().Add(ttl)
+			ttl += r.serveStaleMaxTTL
+		}
+
 		// put value into cache
-		r.resultCache.Put(cacheKey, cacheValue{answer, prefetch}, r.adjustTTLs(answer))
+		r.resultCache.Put(cacheKey, value, ttl)
 	} else if response.Res.Rcode == dns.RcodeNameError {
 		if r.cacheTimeNegative > 0 {
-			// put return code if NXDOMAIN
-			r.resultCache.Put(cacheKey, response.Res.Rcode, r.cacheTimeNegative)
+			// put return code if NXDOMAIN (not partitioned by ECS: negative
+			// answers are not subnet-specific)
+			r.resultCache.Put(baseKey, response.Res.Rcode, r.cacheTimeNegative)
 		}
 	}
 
 	evt.Bus().Publish(evt.CachingResultCacheChanged, r.resultCache.TotalCount())
+	r.reportCacheMetrics()
 
 	if publish && r.redisClient != nil {
 		res := *response.Res
@@ -262,6 +498,17 @@ func (r *CachingResolver) putInCache(cacheKey string, response *model.Response,
 	}
 }
 
+// ecsClientIP returns the client network address to partition the cache by:
+// the address carried in an incoming ECS option if present, otherwise the
+// client's own source address.
+func (r *CachingResolver) ecsClientIP(request *model.Request) net.IP {
+	if subnet := extractECS(request.Req); subnet != nil {
+		return subnet.Address
+	}
+
+	return request.ClientIP
+}
+
 // adjustTTLs calculates and returns the max TTL (considers also the min and max cache time)
 // for all records from answer or a negative cache time for empty answer
 // adjust the TTL in the answer header accordingly
@@ -0,0 +1,28 @@
+package resolver
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCacheValue_IsStale(t *testing.T) {
+	cases := []struct {
+		name       string
+		staleUntil time.Time
+		want       bool
+	}{
+		{"serve-stale disabled (zero staleUntil)", time.Time{}, false},
+		{"not yet stale", time.Now().Add(time.Minute), false},
+		{"past staleUntil", time.Now().Add(-time.Second), true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			v := cacheValue{staleUntil: tc.staleUntil}
+
+			if got := v.isStale(); got != tc.want {
+				t.Fatalf("isStale() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package resolver
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// defaultECSMaxScopeV4 and defaultECSMaxScopeV6 bound the network prefix
+// length used to partition the cache by client subnet, keeping the number of
+// distinct cache entries per domain manageable.
+const (
+	defaultECSMaxScopeV4 = 24
+	defaultECSMaxScopeV6 = 56
+)
+
+// ecsScopeStep is the prefix length granularity tried when looking for a
+// longest-prefix cache match: without a trie-indexed cache, we probe
+// candidate networks at this granularity from the configured max scope down
+// to scope 0 (the ECS-agnostic fallback entry).
+const ecsScopeStep = 8
+
+// extractECS returns the ECS (EDNS Client Subnet, RFC 7871) option attached
+// to req, if any.
+func extractECS(req *dns.Msg) *dns.EDNS0_SUBNET {
+	opt := req.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+
+	for _, o := range opt.Option {
+		if subnet, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return subnet
+		}
+	}
+
+	return nil
+}
+
+// ecsNetworkKey formats the masked network/prefix used as the ECS portion of
+// a cache key, e.g. "192.168.1.0/24". A scope of 0 returns "", since a /0
+// network carries no partitioning information and must collapse onto the
+// same (unsuffixed) key as the scope-0 fallback entry in ecsCandidateKeys.
+func ecsNetworkKey(ip net.IP, scope int) string {
+	if scope == 0 {
+		return ""
+	}
+
+	// net.ParseIP (and the address unpacked from an EDNS0_SUBNET option)
+	// represents IPv4 addresses in their 16-byte form, so len(ip)*8 would be
+	// 128 instead of 32 unless we normalize to the 4-byte form first. Without
+	// this, every IPv4 client's mask would cover none of its actual address
+	// bytes and all of them would collapse onto the same network key.
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+
+	mask := net.CIDRMask(scope, len(ip)*8) //nolint:gomnd
+	network := ip.Mask(mask)
+
+	return fmt.Sprintf("%s/%d", network.String(), scope)
+}
+
+// withECSSuffix appends the ECS network/scope to a base cache key. A scope
+// of 0 (or no network) yields the base key unchanged, which doubles as the
+// fallback entry for clients without an ECS option.
+func withECSSuffix(baseKey, network string) string {
+	if network == "" {
+		return baseKey
+	}
+
+	return baseKey + "|" + network
+}
+
+// ecsMaxScope returns the configured max scope for the given client address
+// family.
+func (r *CachingResolver) ecsMaxScope(ip net.IP) int {
+	if ip.To4() != nil {
+		return r.ecsMaxScopeV4
+	}
+
+	return r.ecsMaxScopeV6
+}
+
+// ecsCandidateKeys returns cache keys to probe, from the most specific
+// (longest prefix, bounded by the configured max scope) down to the
+// scope-0/no-ECS fallback. The caller should return on the first hit, giving
+// longest-prefix-match semantics without requiring a prefix-indexed cache.
+func (r *CachingResolver) ecsCandidateKeys(baseKey string, clientIP net.IP) []string {
+	if clientIP == nil {
+		return []string{baseKey}
+	}
+
+	maxScope := r.ecsMaxScope(clientIP)
+
+	keys := make([]string, 0, maxScope/ecsScopeStep+2)
+
+	for scope := (maxScope / ecsScopeStep) * ecsScopeStep; scope > 0; scope -= ecsScopeStep {
+		keys = append(keys, withECSSuffix(baseKey, ecsNetworkKey(clientIP, scope)))
+	}
+
+	// scope 0: the fallback entry for clients without a matched ECS scope
+	keys = append(keys, baseKey)
+
+	return keys
+}
+
+// ecsStorageScope rounds sourceScope (the SCOPE PREFIX-LENGTH an upstream
+// returned, which RFC 7871 allows to be any value) down to the same
+// ecsScopeStep grid that ecsCandidateKeys probes, and caps it to the
+// configured max scope for ip's address family. Without this, an entry
+// stored under a scope that isn't a multiple of ecsScopeStep (e.g. /20) could
+// never be found again by a later lookup.
+func (r *CachingResolver) ecsStorageScope(ip net.IP, sourceScope int) int {
+	maxScope := (r.ecsMaxScope(ip) / ecsScopeStep) * ecsScopeStep
+	scope := (sourceScope / ecsScopeStep) * ecsScopeStep
+
+	if scope > maxScope {
+		scope = maxScope
+	}
+
+	if scope < 0 {
+		scope = 0
+	}
+
+	return scope
+}
+
+// stripECSSuffix returns the "qtype|domain" portion of a cache key,
+// discarding any "|ecs-network/scope" suffix appended by withECSSuffix.
+func stripECSSuffix(cacheKey string) string {
+	parts := strings.SplitN(cacheKey, "|", 3)
+	if len(parts) < 3 {
+		return cacheKey
+	}
+
+	return parts[0] + "|" + parts[1]
+}
@@ -0,0 +1,93 @@
+package resolver
+
+import (
+	"net"
+	"testing"
+)
+
+func TestEcsNetworkKey_NormalizesIPv4MappedAddresses(t *testing.T) {
+	mapped := net.ParseIP("192.168.1.42") // 16-byte (v4-in-v6) representation
+	pure4 := mapped.To4()
+
+	got := ecsNetworkKey(mapped, 24)
+	want := ecsNetworkKey(pure4, 24)
+
+	if got != want {
+		t.Fatalf("ecsNetworkKey(%v) = %q, want %q (same as the pure 4-byte form)", mapped, got, want)
+	}
+
+	if got != "192.168.1.0/24" {
+		t.Fatalf("ecsNetworkKey(%v, 24) = %q, want %q", mapped, got, "192.168.1.0/24")
+	}
+}
+
+func TestEcsNetworkKey_DistinguishesDifferentV4Clients(t *testing.T) {
+	a := ecsNetworkKey(net.ParseIP("10.0.1.5"), 24)
+	b := ecsNetworkKey(net.ParseIP("10.0.2.5"), 24)
+
+	if a == b {
+		t.Fatalf("expected different /24 networks to produce different keys, both got %q", a)
+	}
+}
+
+func TestEcsStorageScope_RoundsDownToStepGrid(t *testing.T) {
+	r := &CachingResolver{ecsMaxScopeV4: defaultECSMaxScopeV4, ecsMaxScopeV6: defaultECSMaxScopeV6}
+
+	ip := net.ParseIP("203.0.113.9")
+
+	// RFC 7871 allows any SCOPE PREFIX-LENGTH; 20 isn't a multiple of ecsScopeStep
+	got := r.ecsStorageScope(ip, 20)
+	if got != 16 {
+		t.Fatalf("ecsStorageScope(scope=20) = %d, want 16 (rounded down to the step grid)", got)
+	}
+}
+
+func TestEcsStorageScope_CapsAtConfiguredMaxScope(t *testing.T) {
+	r := &CachingResolver{ecsMaxScopeV4: defaultECSMaxScopeV4, ecsMaxScopeV6: defaultECSMaxScopeV6}
+
+	ip := net.ParseIP("203.0.113.9")
+
+	got := r.ecsStorageScope(ip, 32)
+	if got != defaultECSMaxScopeV4 {
+		t.Fatalf("ecsStorageScope(scope=32) = %d, want capped at %d", got, defaultECSMaxScopeV4)
+	}
+}
+
+func TestEcsStorageScope_IsAlwaysAmongLookupCandidates(t *testing.T) {
+	r := &CachingResolver{ecsMaxScopeV4: defaultECSMaxScopeV4, ecsMaxScopeV6: defaultECSMaxScopeV6}
+
+	ip := net.ParseIP("203.0.113.9")
+	baseKey := "1|a.com."
+
+	for _, sourceScope := range []int{0, 7, 8, 15, 20, 24, 32} {
+		scope := r.ecsStorageScope(ip, sourceScope)
+		writeKey := withECSSuffix(baseKey, ecsNetworkKey(ip, scope))
+
+		found := false
+
+		for _, candidate := range r.ecsCandidateKeys(baseKey, ip) {
+			if candidate == writeKey {
+				found = true
+
+				break
+			}
+		}
+
+		if !found {
+			t.Fatalf("sourceScope=%d: write key %q not reachable via ecsCandidateKeys", sourceScope, writeKey)
+		}
+	}
+}
+
+func TestStripECSSuffix(t *testing.T) {
+	base := "1|a.com."
+	suffixed := withECSSuffix(base, "192.168.1.0/24")
+
+	if got := stripECSSuffix(suffixed); got != base {
+		t.Fatalf("stripECSSuffix(%q) = %q, want %q", suffixed, got, base)
+	}
+
+	if got := stripECSSuffix(base); got != base {
+		t.Fatalf("stripECSSuffix(%q) = %q, want unchanged %q", base, got, base)
+	}
+}
@@ -0,0 +1,306 @@
+package resolver
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/0xERR0R/blocky/cache/expirationcache"
+
+	"github.com/miekg/dns"
+)
+
+// promoteAfterHits is the number of cold-cache hits after which an entry is
+// promoted into the hot LRU (SLRU-style admission: a single hit isn't enough
+// to prove an entry is worth the hot tier's limited space).
+const promoteAfterHits = 2
+
+// hotEntry is one item held in the hot LRU tier.
+type hotEntry struct {
+	key       string
+	value     interface{}
+	expiresAt time.Time
+}
+
+// twoTierCache is a size-aware expirationcache.ExpiringCache with a small hot
+// LRU in front of the regular TTL-managed (cold) cache. Entries start in the
+// cold cache and are promoted to the hot tier once they've been hit more than
+// once, following the 2Q/SLRU family of admission policies. Total memory use
+// is additionally bounded by the serialized size of cached answers, since a
+// handful of large TXT/HTTPS/SVCB responses can otherwise blow the memory
+// budget of a low-RAM device well before the item-count limit is reached.
+type twoTierCache struct {
+	cold expirationcache.ExpiringCache
+
+	mu        sync.Mutex
+	hotItems  int
+	hotList   *list.List
+	hotIndex  map[string]*list.Element
+	hitCounts map[string]int
+	sizes     map[string]int // key -> size, for every key currently resident (hot or cold)
+
+	maxSizeBytes int64
+	usedBytes    int64
+
+	onAdmissionRejected func()
+}
+
+// newTwoTierCache creates a twoTierCache with hotItems slots in the hot tier.
+// The caller must set the returned cache's cold field before using it,
+// typically to a cache whose expiry callback comes from wrapOnExpired (see
+// below), since that callback needs a reference to the twoTierCache to
+// release accounting for keys that actually leave the cache.
+func newTwoTierCache(hotItems int, maxSizeBytes int64) *twoTierCache {
+	return &twoTierCache{
+		hotItems:     hotItems,
+		hotList:      list.New(),
+		hotIndex:     make(map[string]*list.Element),
+		hitCounts:    make(map[string]int),
+		sizes:        make(map[string]int),
+		maxSizeBytes: maxSizeBytes,
+	}
+}
+
+// wrapOnExpired wraps inner (the resolver's own onExpired handler, used for
+// prefetching; may be nil) so that byte-size accounting for cacheKey is kept
+// in sync with what the cold cache actually holds: released when the entry
+// really leaves the cache (inner returns no replacement value), or updated to
+// the new value's size when inner refreshes it in place (e.g. via prefetch).
+// Without this hook, usedBytes/sizes only ever shrink when the same key is
+// Put again, so they drift upward forever and the cache eventually stops
+// admitting new entries even though the cold cache has long since shrunk via
+// normal TTL expiry.
+func (c *twoTierCache) wrapOnExpired(
+	inner func(cacheKey string) (interface{}, time.Duration),
+) func(cacheKey string) (interface{}, time.Duration) {
+	return func(cacheKey string) (interface{}, time.Duration) {
+		var val interface{}
+
+		var ttl time.Duration
+
+		if inner != nil {
+			val, ttl = inner(cacheKey)
+		}
+
+		if val != nil {
+			c.trackSize(cacheKey, val)
+		} else {
+			c.release(cacheKey)
+		}
+
+		return val, ttl
+	}
+}
+
+// Get looks up key, checking the hot tier first.
+func (c *twoTierCache) Get(key string) (interface{}, time.Duration) {
+	c.mu.Lock()
+
+	if el, ok := c.hotIndex[key]; ok {
+		e := el.Value.(*hotEntry)
+
+		remaining := time.Until(e.expiresAt)
+		if remaining > 0 {
+			c.hotList.MoveToFront(el)
+			c.mu.Unlock()
+
+			return e.value, remaining
+		}
+
+		// The hot entry outlived its copy of the TTL, but the cold cache
+		// (the source of truth) may still hold a fresher value, e.g. if it
+		// was refreshed by prefetch after being promoted. Fall through to
+		// the cold lookup below instead of reporting a flat miss.
+		c.removeHotLocked(el)
+	}
+
+	c.mu.Unlock()
+
+	val, ttl := c.cold.Get(key)
+	if val == nil {
+		return nil, 0
+	}
+
+	c.mu.Lock()
+	c.hitCounts[key]++
+	hits := c.hitCounts[key]
+	c.mu.Unlock()
+
+	if hits >= promoteAfterHits {
+		c.promote(key, val, ttl)
+	}
+
+	return val, ttl
+}
+
+// Peek returns the current value and remaining TTL for key, like Get, but
+// without Get's side effects (cold-tier hit-count bookkeeping and promotion
+// to the hot tier). Intended for callers that need to inspect/iterate the
+// cache's contents, such as persistence snapshots, without that inspection
+// itself influencing which entries get promoted.
+func (c *twoTierCache) Peek(key string) (interface{}, time.Duration) {
+	c.mu.Lock()
+
+	if el, ok := c.hotIndex[key]; ok {
+		e := el.Value.(*hotEntry)
+
+		if remaining := time.Until(e.expiresAt); remaining > 0 {
+			c.mu.Unlock()
+
+			return e.value, remaining
+		}
+	}
+
+	c.mu.Unlock()
+
+	return c.cold.Get(key)
+}
+
+// Put stores key/val in the cold cache with the given ttl, subject to the
+// overall byte-size budget. Admission is rejected (the entry isn't cached,
+// and onAdmissionRejected is invoked) if it would push usedBytes over
+// maxSizeBytes; usedBytes itself recedes only as entries actually expire out
+// of the cold cache (see wrapOnExpired) or are replaced by a smaller value for
+// the same key, so a rejection is expected to be transient rather than
+// permanent under normal TTL churn.
+func (c *twoTierCache) Put(key string, val interface{}, ttl time.Duration) {
+	size := estimateSize(val)
+
+	c.mu.Lock()
+
+	oldSize, hadOldSize := c.sizes[key]
+	if hadOldSize {
+		c.usedBytes -= int64(oldSize)
+	}
+
+	if c.maxSizeBytes > 0 && c.usedBytes+int64(size) > c.maxSizeBytes {
+		// Reject admission, but restore the accounting for the key's
+		// previous (still resident, unchanged) entry instead of dropping it:
+		// this Put never took effect, so usedBytes/sizes must still reflect
+		// what's actually in the cold cache.
+		if hadOldSize {
+			c.usedBytes += int64(oldSize)
+		}
+
+		c.mu.Unlock()
+
+		if c.onAdmissionRejected != nil {
+			c.onAdmissionRejected()
+		}
+
+		return
+	}
+
+	c.sizes[key] = size
+	c.usedBytes += int64(size)
+	delete(c.hitCounts, key)
+	c.mu.Unlock()
+
+	c.cold.Put(key, val, ttl)
+}
+
+// release drops cacheKey from all bookkeeping (byte accounting, hit counts,
+// and the hot tier) because it has actually left the cold cache.
+func (c *twoTierCache) release(cacheKey string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if size, ok := c.sizes[cacheKey]; ok {
+		c.usedBytes -= int64(size)
+		delete(c.sizes, cacheKey)
+	}
+
+	delete(c.hitCounts, cacheKey)
+
+	if el, ok := c.hotIndex[cacheKey]; ok {
+		c.removeHotLocked(el)
+	}
+}
+
+// trackSize updates the accounted size of cacheKey to match val, e.g. after
+// a prefetch refresh replaced it with a new answer.
+func (c *twoTierCache) trackSize(cacheKey string, val interface{}) {
+	size := estimateSize(val)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if oldSize, ok := c.sizes[cacheKey]; ok {
+		c.usedBytes -= int64(oldSize)
+	}
+
+	c.sizes[cacheKey] = size
+	c.usedBytes += int64(size)
+}
+
+// promote moves key from the cold cache into the hot LRU, evicting the least
+// recently used hot entry first if the hot tier is full.
+func (c *twoTierCache) promote(key string, val interface{}, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.hotIndex[key]; ok {
+		c.hotList.MoveToFront(el)
+		el.Value.(*hotEntry).expiresAt = time.Now().Add(ttl)
+
+		return
+	}
+
+	for c.hotList.Len() >= c.hotItems && c.hotList.Len() > 0 {
+		c.removeHotLocked(c.hotList.Back())
+	}
+
+	el := c.hotList.PushFront(&hotEntry{key: key, value: val, expiresAt: time.Now().Add(ttl)})
+	c.hotIndex[key] = el
+}
+
+// removeHotLocked removes el from the hot LRU. c.mu must be held.
+func (c *twoTierCache) removeHotLocked(el *list.Element) {
+	e := el.Value.(*hotEntry)
+	c.hotList.Remove(el)
+	delete(c.hotIndex, e.key)
+}
+
+// TotalCount returns the number of entries resident in either tier.
+func (c *twoTierCache) TotalCount() int {
+	return c.cold.TotalCount()
+}
+
+// Keys returns the keys resident in the cold (authoritative) cache.
+func (c *twoTierCache) Keys() []string {
+	return c.cold.Keys()
+}
+
+// bytesUsed returns the current estimated total size, in bytes, of all
+// cached answers.
+func (c *twoTierCache) bytesUsed() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.usedBytes
+}
+
+// hotCount returns the number of entries currently promoted to the hot tier.
+func (c *twoTierCache) hotCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.hotList.Len()
+}
+
+// estimateSize returns the approximate serialized size, in bytes, of a
+// cacheValue (or other value put into the result cache).
+func estimateSize(val interface{}) int {
+	v, ok := val.(cacheValue)
+	if !ok {
+		// negative (NXDOMAIN) entries are a single return code: negligible
+		return 1
+	}
+
+	size := 0
+	for _, rr := range v.answer {
+		size += dns.Len(rr)
+	}
+
+	return size
+}
@@ -0,0 +1,169 @@
+package resolver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/0xERR0R/blocky/cache/expirationcache"
+
+	"github.com/miekg/dns"
+)
+
+// newTestTwoTierCache wires a twoTierCache to a real cold expirationcache.Cache
+// the same way configureCaches does, so wrapOnExpired actually fires when an
+// entry's TTL passes.
+func newTestTwoTierCache(hotItems int, maxSizeBytes int64) *twoTierCache {
+	tt := newTwoTierCache(hotItems, maxSizeBytes)
+	tt.cold = expirationcache.NewCache(
+		expirationcache.WithCleanUpInterval(10*time.Millisecond),
+		expirationcache.WithOnExpiredFn(tt.wrapOnExpired(nil)),
+	)
+
+	return tt
+}
+
+func testAnswer(domain string, payloadSize int) []dns.RR {
+	payload := make([]byte, payloadSize)
+	for i := range payload {
+		payload[i] = 'a'
+	}
+
+	rr := &dns.TXT{
+		Hdr: dns.RR_Header{Name: dns.Fqdn(domain), Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+		Txt: []string{string(payload)},
+	}
+
+	return []dns.RR{rr}
+}
+
+func TestTwoTierCache_PromotesOnSecondHit(t *testing.T) {
+	tt := newTestTwoTierCache(10, 0)
+
+	tt.Put("a.com.|1", cacheValue{answer: testAnswer("a.com", 4)}, time.Minute)
+
+	if tt.hotCount() != 0 {
+		t.Fatalf("expected no hot entries before any hit, got %d", tt.hotCount())
+	}
+
+	if val, _ := tt.Get("a.com.|1"); val == nil {
+		t.Fatal("expected first Get to hit the cold cache")
+	}
+
+	if tt.hotCount() != 0 {
+		t.Fatalf("expected no promotion after a single hit, got %d hot entries", tt.hotCount())
+	}
+
+	if val, _ := tt.Get("a.com.|1"); val == nil {
+		t.Fatal("expected second Get to hit the cold cache")
+	}
+
+	if tt.hotCount() != 1 {
+		t.Fatalf("expected promotion to hot tier after second hit, got %d hot entries", tt.hotCount())
+	}
+}
+
+func TestTwoTierCache_ReleasesBytesOnExpiry(t *testing.T) {
+	tt := newTestTwoTierCache(10, 1000)
+
+	tt.Put("a.com.|1", cacheValue{answer: testAnswer("a.com", 100)}, 20*time.Millisecond)
+
+	if tt.bytesUsed() == 0 {
+		t.Fatal("expected bytesUsed to reflect the stored entry")
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for tt.bytesUsed() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if used := tt.bytesUsed(); used != 0 {
+		t.Fatalf("expected bytesUsed to drop to 0 once the entry expired, got %d", used)
+	}
+}
+
+func TestTwoTierCache_RejectsAdmissionOverBudget(t *testing.T) {
+	tt := newTestTwoTierCache(10, 10)
+
+	tt.Put("a.com.|1", cacheValue{answer: testAnswer("a.com", 100)}, time.Minute)
+
+	if val, _ := tt.Get("a.com.|1"); val != nil {
+		t.Fatal("expected oversized entry to be rejected, not cached")
+	}
+
+	if tt.bytesUsed() != 0 {
+		t.Fatalf("expected bytesUsed to remain 0 after a rejected admission, got %d", tt.bytesUsed())
+	}
+}
+
+func TestTwoTierCache_PutReplacesSizeOfExistingKey(t *testing.T) {
+	tt := newTestTwoTierCache(10, 1000)
+
+	tt.Put("a.com.|1", cacheValue{answer: testAnswer("a.com", 50)}, time.Minute)
+	firstSize := tt.bytesUsed()
+
+	tt.Put("a.com.|1", cacheValue{answer: testAnswer("a.com", 10)}, time.Minute)
+	secondSize := tt.bytesUsed()
+
+	if secondSize >= firstSize {
+		t.Fatalf("expected re-Put with a smaller answer to shrink bytesUsed, got %d -> %d", firstSize, secondSize)
+	}
+}
+
+func TestTwoTierCache_RejectedPutPreservesExistingKeyAccounting(t *testing.T) {
+	tt := newTestTwoTierCache(10, 100)
+
+	tt.Put("a.com.|1", cacheValue{answer: testAnswer("a.com", 50)}, time.Minute)
+	before := tt.bytesUsed()
+
+	// Too big to fit alongside the existing entry: rejected, but "a.com.|1"
+	// itself must remain fully accounted for.
+	tt.Put("b.com.|1", cacheValue{answer: testAnswer("b.com", 100)}, time.Minute)
+
+	if after := tt.bytesUsed(); after != before {
+		t.Fatalf("expected bytesUsed to stay at %d after a rejected Put, got %d", before, after)
+	}
+
+	if val, _ := tt.Get("a.com.|1"); val == nil {
+		t.Fatal("expected existing key to remain cached after an unrelated rejected Put")
+	}
+}
+
+func TestTwoTierCache_GetFallsThroughToColdOnExpiredHotEntry(t *testing.T) {
+	tt := newTestTwoTierCache(10, 0)
+
+	tt.Put("a.com.|1", cacheValue{answer: testAnswer("a.com", 4)}, time.Hour)
+
+	// Force a promotion, then make the hot copy look expired without
+	// touching the (still valid) cold entry.
+	tt.Get("a.com.|1")
+	tt.Get("a.com.|1")
+
+	if tt.hotCount() != 1 {
+		t.Fatalf("expected entry to be promoted to the hot tier, got %d hot entries", tt.hotCount())
+	}
+
+	tt.mu.Lock()
+	tt.hotIndex["a.com.|1"].Value.(*hotEntry).expiresAt = time.Now().Add(-time.Second)
+	tt.mu.Unlock()
+
+	val, _ := tt.Get("a.com.|1")
+	if val == nil {
+		t.Fatal("expected Get to fall through to the cold cache instead of reporting a flat miss")
+	}
+}
+
+func TestTwoTierCache_PeekDoesNotPromote(t *testing.T) {
+	tt := newTestTwoTierCache(10, 0)
+
+	tt.Put("a.com.|1", cacheValue{answer: testAnswer("a.com", 4)}, time.Minute)
+
+	for i := 0; i < promoteAfterHits+1; i++ {
+		if val, _ := tt.Peek("a.com.|1"); val == nil {
+			t.Fatal("expected Peek to find the cold cache entry")
+		}
+	}
+
+	if tt.hotCount() != 0 {
+		t.Fatalf("expected Peek to never promote an entry, got %d hot entries", tt.hotCount())
+	}
+}